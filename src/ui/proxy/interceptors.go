@@ -7,7 +7,6 @@ import (
 	"github.com/vmware/harbor/src/common/models"
 	"github.com/vmware/harbor/src/common/utils/clair"
 	"github.com/vmware/harbor/src/common/utils/log"
-	"github.com/vmware/harbor/src/common/utils/notary"
 	//	"github.com/vmware/harbor/src/ui/api"
 	"github.com/vmware/harbor/src/ui/config"
 	"github.com/vmware/harbor/src/ui/projectmanager"
@@ -19,6 +18,7 @@ import (
 	"os"
 	"regexp"
 	"strings"
+	"time"
 )
 
 type contextKey string
@@ -56,33 +56,49 @@ func MatchPullManifest(req *http.Request) (bool, string, string) {
 
 // policyChecker checks the policy of a project by project name, to determine if it's needed to check the image's status under this project.
 type policyChecker interface {
-	// contentTrustEnabled returns whether a project has enabled content trust.
-	contentTrustEnabled(name string) bool
 	// vulnerablePolicy  returns whether a project has enabled vulnerable, and the project's severity.
 	vulnerablePolicy(name string) (bool, models.Severity)
+	// pullThroughRemote returns whether a project is configured as a pull-through
+	// mirror, and if so the upstream remote endpoint and credentials to use.
+	pullThroughRemote(name string) (bool, models.PullThroughRemote)
+	// trustPolicy returns the Notary trust policy configured for a project,
+	// including whether content trust is enabled for it.
+	trustPolicy(name string) models.TrustPolicy
 }
 
 //For testing
 type envPolicyChecker struct{}
 
-func (ec envPolicyChecker) contentTrustEnabled(name string) bool {
-	return os.Getenv("PROJECT_CONTENT_TRUST") == "1"
-}
 func (ec envPolicyChecker) vulnerablePolicy(name string) (bool, models.Severity) {
 	return os.Getenv("PROJECT_VULNERABLE") == "1", clair.ParseClairSev(os.Getenv("PROJECT_SEVERITY"))
 }
+func (ec envPolicyChecker) trustPolicy(name string) models.TrustPolicy {
+	return models.TrustPolicy{
+		Enabled: os.Getenv("PROJECT_CONTENT_TRUST") == "1",
+	}
+}
+func (ec envPolicyChecker) pullThroughRemote(name string) (bool, models.PullThroughRemote) {
+	if os.Getenv("PROJECT_PULLTHROUGH") != "1" {
+		return false, models.PullThroughRemote{}
+	}
+	return true, models.PullThroughRemote{
+		Endpoint: os.Getenv("PROJECT_PULLTHROUGH_ENDPOINT"),
+		Username: os.Getenv("PROJECT_PULLTHROUGH_USERNAME"),
+		Password: os.Getenv("PROJECT_PULLTHROUGH_PASSWORD"),
+	}
+}
 
 type pmsPolicyChecker struct {
 	pm projectmanager.ProjectManager
 }
 
-func (pc pmsPolicyChecker) contentTrustEnabled(name string) bool {
+func (pc pmsPolicyChecker) trustPolicy(name string) models.TrustPolicy {
 	project, err := pc.pm.Get(name)
 	if err != nil {
 		log.Errorf("Unexpected error when getting the project, error: %v", err)
-		return true
+		return models.TrustPolicy{Enabled: true}
 	}
-	return project.EnableContentTrust
+	return project.TrustPolicy
 }
 func (pc pmsPolicyChecker) vulnerablePolicy(name string) (bool, models.Severity) {
 	project, err := pc.pm.Get(name)
@@ -92,6 +108,14 @@ func (pc pmsPolicyChecker) vulnerablePolicy(name string) (bool, models.Severity)
 	}
 	return project.PreventVulnerableImagesFromRunning, clair.ParseClairSev(project.PreventVulnerableImagesFromRunningSeverity)
 }
+func (pc pmsPolicyChecker) pullThroughRemote(name string) (bool, models.PullThroughRemote) {
+	project, err := pc.pm.Get(name)
+	if err != nil {
+		log.Errorf("Unexpected error when getting the project, error: %v", err)
+		return false, models.PullThroughRemote{}
+	}
+	return project.PullThroughRemote.Endpoint != "", project.PullThroughRemote
+}
 
 // newPMSPolicyChecker returns an instance of an pmsPolicyChecker
 func newPMSPolicyChecker(pm projectmanager.ProjectManager) policyChecker {
@@ -113,6 +137,13 @@ type imageInfo struct {
 	tag         string
 	projectName string
 	digest      string
+	// isManifestList is true when the pulled Content-Type identified a
+	// Docker schema2 manifest list or an OCI image index, regardless of
+	// whether any child descriptors were actually parsed out of it.
+	isManifestList bool
+	// manifests holds the per-platform child images when isManifestList is
+	// true; empty otherwise.
+	manifests []childImage
 }
 
 type urlHandler struct {
@@ -132,7 +163,9 @@ func (uh urlHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 			return
 		}
 		rec = httptest.NewRecorder()
+		start := time.Now()
 		uh.next.ServeHTTP(rec, req)
+		observeLatency("response_capture", start)
 		if rec.Result().StatusCode != http.StatusOK {
 			copyResp(rec, rw)
 			return
@@ -144,6 +177,15 @@ func (uh urlHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 			projectName: components[0],
 			digest:      digest,
 		}
+		if isFatManifest(rec.Header().Get(http.CanonicalHeaderKey("Content-Type"))) {
+			img.isManifestList = true
+			children, err := parseChildImages(rec.Body.Bytes())
+			if err != nil {
+				http.Error(rw, marshalError(fmt.Sprintf("Failed to parse manifest list: %v", err), http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			img.manifests = children
+		}
 		log.Debugf("image info of the request: %#v", img)
 		ctx := context.WithValue(req.Context(), imageInfoCtxKey, img)
 		req = req.WithContext(ctx)
@@ -162,20 +204,57 @@ func (cth contentTrustHandler) ServeHTTP(rw http.ResponseWriter, req *http.Reque
 		return
 	}
 	img, _ := req.Context().Value(imageInfoCtxKey).(imageInfo)
-	if !getPolicyChecker().contentTrustEnabled(img.projectName) {
+	policy := getPolicyChecker().trustPolicy(img.projectName)
+	if !policy.Enabled {
 		cth.next.ServeHTTP(rw, req)
 		return
 	}
-	match, err := matchNotaryDigest(img)
+	start := time.Now()
+	match, err := matchNotaryDigest(img, policy)
+	observeLatency("content_trust", start)
 	if err != nil {
+		if trustErr, ok := err.(trustPolicyError); ok {
+			log.Debugf("trust policy violation for %#v: %v", img, trustErr)
+			contentTrustDeniedTotal.WithLabelValues(img.projectName).Inc()
+			auditDenial(req, img, trustErr.Error(), models.SevUnknown)
+			http.Error(rw, marshalError(trustErr.Error(), http.StatusPreconditionFailed), http.StatusPreconditionFailed)
+			return
+		}
 		http.Error(rw, marshalError("Failed in communication with Notary please check the log", http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
 	if !match {
 		log.Debugf("digest mismatch, failing the response.")
+		contentTrustDeniedTotal.WithLabelValues(img.projectName).Inc()
+		auditDenial(req, img, "not signed in Notary", models.SevUnknown)
 		http.Error(rw, marshalError("The image is not signed in Notary.", http.StatusPreconditionFailed), http.StatusPreconditionFailed)
 		return
 	}
+	// Docker Content Trust only ever signs the tag, which is what matchNotaryDigest
+	// just verified against img.digest: the signed target *is* the manifest
+	// list digest, and that digest is a hash over the document embedding
+	// every child descriptor below, so a substituted child would already
+	// have failed the match above. Per-platform child images are never
+	// independent Notary targets, so there is nothing further to check them
+	// against; what's left to guard here is a registry handing back a list
+	// that claims to be a manifest list/OCI index but carries no (or
+	// malformed) child descriptors.
+	if img.isManifestList && len(img.manifests) == 0 {
+		log.Debugf("manifest list for %#v has no child manifests, failing the response.", img)
+		contentTrustDeniedTotal.WithLabelValues(img.projectName).Inc()
+		auditDenial(req, img, "manifest list contained no child images", models.SevUnknown)
+		http.Error(rw, marshalError("The manifest list contains no child images.", http.StatusPreconditionFailed), http.StatusPreconditionFailed)
+		return
+	}
+	for _, child := range img.manifests {
+		if child.digest == "" {
+			log.Debugf("child manifest for platform %s in %#v has no digest, failing the response.", child.platform, img)
+			contentTrustDeniedTotal.WithLabelValues(img.projectName).Inc()
+			auditDenial(req, img, "child image missing digest", models.SevUnknown)
+			http.Error(rw, marshalError(fmt.Sprintf("The child image for platform %s has no digest.", child.platform), http.StatusPreconditionFailed), http.StatusPreconditionFailed)
+			return
+		}
+	}
 	cth.next.ServeHTTP(rw, req)
 }
 
@@ -195,23 +274,49 @@ func (vh vulnerableHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request)
 		vh.next.ServeHTTP(rw, req)
 		return
 	}
-	overview, err := dao.GetImgScanOverview(img.digest)
-	if err != nil {
-		log.Errorf("failed to get ImgScanOverview with repo: %s, tag: %s, digest: %s. Error: %v", img.repository, img.tag, img.digest, err)
-		http.Error(rw, marshalError("Failed to get ImgScanOverview.", http.StatusPreconditionFailed), http.StatusPreconditionFailed)
+	// A manifest list fans out to one scan overview per referenced platform
+	// image; a plain manifest is just the one digest it already carries. A
+	// manifest list that parsed out to zero children is treated as a
+	// failure rather than "nothing to check", since serving it through
+	// unchecked would silently bypass the vulnerability policy entirely.
+	if img.isManifestList && len(img.manifests) == 0 {
+		log.Debugf("manifest list for %#v has no child manifests, failing the response.", img)
+		auditDenial(req, img, "manifest list contained no child images", models.SevUnknown)
+		http.Error(rw, marshalError("The manifest list contains no child images.", http.StatusPreconditionFailed), http.StatusPreconditionFailed)
 		return
 	}
-	if overview == nil {
-		log.Debugf("cannot get the image scan overview info, failing the response.")
-		http.Error(rw, marshalError("Cannot get the image scan overview info.", http.StatusPreconditionFailed), http.StatusPreconditionFailed)
-		return
+	digests := []string{img.digest}
+	if len(img.manifests) > 0 {
+		digests = digests[:0]
+		for _, child := range img.manifests {
+			digests = append(digests, child.digest)
+		}
 	}
-	imageSev := overview.Sev
-	if imageSev >= int(projectVulnerableSeverity) {
-		log.Debugf("the image severity: %q is higher then project setting: %q, failing the response.", models.Severity(imageSev), projectVulnerableSeverity)
-		http.Error(rw, marshalError(fmt.Sprintf("The severity of vulnerability of the image: %q is equal or higher than the threshold in project setting: %q.", models.Severity(imageSev), projectVulnerableSeverity),
-			http.StatusPreconditionFailed), http.StatusPreconditionFailed)
-		return
+	for _, digest := range digests {
+		start := time.Now()
+		overview, err := dao.GetImgScanOverview(digest)
+		observeLatency("vulnerability", start)
+		if err != nil {
+			log.Errorf("failed to get ImgScanOverview with repo: %s, tag: %s, digest: %s. Error: %v", img.repository, img.tag, digest, err)
+			http.Error(rw, marshalError("Failed to get ImgScanOverview.", http.StatusPreconditionFailed), http.StatusPreconditionFailed)
+			return
+		}
+		if overview == nil {
+			log.Debugf("cannot get the image scan overview info, failing the response.")
+			auditDenial(req, imageInfo{repository: img.repository, tag: img.tag, projectName: img.projectName, digest: digest}, "image scan overview not available", models.SevUnknown)
+			http.Error(rw, marshalError("Cannot get the image scan overview info.", http.StatusPreconditionFailed), http.StatusPreconditionFailed)
+			return
+		}
+		imageSev := overview.Sev
+		if imageSev >= int(projectVulnerableSeverity) {
+			sev := models.Severity(imageSev)
+			log.Debugf("the image severity: %q is higher then project setting: %q, failing the response.", sev, projectVulnerableSeverity)
+			vulnerabilityDeniedTotal.WithLabelValues(img.projectName, sev.String()).Inc()
+			auditDenial(req, imageInfo{repository: img.repository, tag: img.tag, projectName: img.projectName, digest: digest}, "vulnerability severity threshold exceeded", sev)
+			http.Error(rw, marshalError(fmt.Sprintf("The severity of vulnerability of the image: %q is equal or higher than the threshold in project setting: %q.", sev, projectVulnerableSeverity),
+				http.StatusPreconditionFailed), http.StatusPreconditionFailed)
+			return
+		}
 	}
 	vh.next.ServeHTTP(rw, req)
 }
@@ -223,6 +328,13 @@ type funnelHandler struct {
 func (fu funnelHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	imgRaw := req.Context().Value(imageInfoCtxKey)
 	if imgRaw != nil {
+		// Reaching here means every upstream check (content trust,
+		// vulnerability) that ran for this pull passed, since a denial
+		// returns early with an http.Error and never falls through to the
+		// funnel; this is therefore the single terminal point at which an
+		// "allowed" pull is counted.
+		img, _ := imgRaw.(imageInfo)
+		pullsTotal.WithLabelValues("allowed", img.projectName).Inc()
 		log.Debugf("Return the original response as no the interceptor takes action.")
 		copyResp(rec, rw)
 		return
@@ -230,25 +342,6 @@ func (fu funnelHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	fu.next.ServeHTTP(rw, req)
 }
 
-func matchNotaryDigest(img imageInfo) (bool, error) {
-	targets, err := notary.GetInternalTargets(NotaryEndpoint, tokenUsername, img.repository)
-	if err != nil {
-		return false, err
-	}
-	for _, t := range targets {
-		if t.Tag == img.tag {
-			log.Debugf("found tag: %s in notary, try to match digest.", img.tag)
-			d, err := notary.DigestFromTarget(t)
-			if err != nil {
-				return false, err
-			}
-			return img.digest == d, nil
-		}
-	}
-	log.Debugf("image: %#v, not found in notary", img)
-	return false, nil
-}
-
 func copyResp(rec *httptest.ResponseRecorder, rw http.ResponseWriter) {
 	for k, v := range rec.Header() {
 		rw.Header()[k] = v
@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// stubRegistry answers a manifest pull with a fixed status/content-type/body,
+// standing in for the real docker registry backend.
+type stubRegistry struct {
+	contentType string
+	digest      string
+	body        string
+}
+
+func (s stubRegistry) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", s.contentType)
+	rw.Header().Set("Docker-Content-Digest", s.digest)
+	rw.WriteHeader(http.StatusOK)
+	rw.Write([]byte(s.body))
+}
+
+// captureNext records the imageInfo urlHandler attached to the request
+// context, so tests can assert on it without needing the rest of the chain.
+type captureNext struct {
+	got imageInfo
+}
+
+func (c *captureNext) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	img, _ := req.Context().Value(imageInfoCtxKey).(imageInfo)
+	c.got = img
+	rw.WriteHeader(http.StatusOK)
+}
+
+func newManifestRequest() *http.Request {
+	return httptest.NewRequest(http.MethodGet, "/v2/library/photon/manifests/latest", nil)
+}
+
+func TestUrlHandlerSchemaV1Manifest(t *testing.T) {
+	next := &captureNext{}
+	uh := urlHandler{next: stubHandlerThenCapture(stubRegistry{
+		contentType: "application/vnd.docker.distribution.manifest.v1+prettyjws",
+		digest:      "sha256:v1digest",
+		body:        `{"schemaVersion":1}`,
+	}, next)}
+	uh.ServeHTTP(httptest.NewRecorder(), newManifestRequest())
+
+	if next.got.isManifestList {
+		t.Fatal("schema v1 manifest should not be treated as a manifest list")
+	}
+	if next.got.digest != "sha256:v1digest" {
+		t.Fatalf("unexpected digest: %s", next.got.digest)
+	}
+}
+
+func TestUrlHandlerSchemaV2Manifest(t *testing.T) {
+	next := &captureNext{}
+	uh := urlHandler{next: stubHandlerThenCapture(stubRegistry{
+		contentType: "application/vnd.docker.distribution.manifest.v2+json",
+		digest:      "sha256:v2digest",
+		body:        `{"schemaVersion":2,"config":{"digest":"sha256:cfg"}}`,
+	}, next)}
+	uh.ServeHTTP(httptest.NewRecorder(), newManifestRequest())
+
+	if next.got.isManifestList {
+		t.Fatal("single schema v2 manifest should not be treated as a manifest list")
+	}
+	if len(next.got.manifests) != 0 {
+		t.Fatalf("expected no child manifests, got %d", len(next.got.manifests))
+	}
+}
+
+func TestUrlHandlerManifestList(t *testing.T) {
+	next := &captureNext{}
+	uh := urlHandler{next: stubHandlerThenCapture(stubRegistry{
+		contentType: "application/vnd.docker.distribution.manifest.list.v2+json",
+		digest:      "sha256:listdigest",
+		body: `{
+			"schemaVersion": 2,
+			"mediaType": "application/vnd.docker.distribution.manifest.list.v2+json",
+			"manifests": [
+				{"digest": "sha256:amd64digest", "platform": {"architecture": "amd64", "os": "linux"}}
+			]
+		}`,
+	}, next)}
+	uh.ServeHTTP(httptest.NewRecorder(), newManifestRequest())
+
+	if !next.got.isManifestList {
+		t.Fatal("expected the manifest list to be flagged as such")
+	}
+	if len(next.got.manifests) != 1 || next.got.manifests[0].digest != "sha256:amd64digest" {
+		t.Fatalf("unexpected children: %#v", next.got.manifests)
+	}
+}
+
+// stubHandlerThenCapture mirrors the real proxy chain's shape: urlHandler
+// calls its next handler twice per manifest pull, once into its internal
+// recorder to inspect the response and once for real. This stub answers the
+// first call from backend and routes the second into next so tests can
+// assert on the imageInfo urlHandler attached to the request context.
+func stubHandlerThenCapture(backend http.Handler, next http.Handler) http.Handler {
+	calls := 0
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		calls++
+		if calls == 1 {
+			backend.ServeHTTP(rw, req)
+			return
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"encoding/json"
+
+	"github.com/vmware/harbor/src/common/utils/log"
+)
+
+const (
+	manifestListMediaType  = "application/vnd.docker.distribution.manifest.list.v2+json"
+	ociImageIndexMediaType = "application/vnd.oci.image.index.v1+json"
+)
+
+// childImage describes one of the platform-specific manifests referenced by
+// a Docker schema2 manifest list or an OCI image index.
+type childImage struct {
+	digest   string
+	platform string
+}
+
+// manifestListDescriptor mirrors the "manifests" entries of a schema2
+// manifest list / OCI image index; the two formats share this shape.
+type manifestListDescriptor struct {
+	Digest   string `json:"digest"`
+	Platform struct {
+		Architecture string `json:"architecture"`
+		OS           string `json:"os"`
+	} `json:"platform"`
+}
+
+type manifestList struct {
+	MediaType string                   `json:"mediaType"`
+	Manifests []manifestListDescriptor `json:"manifests"`
+}
+
+// isFatManifest returns whether the given Content-Type identifies a
+// manifest list (multi-arch "fat" manifest) rather than a single image
+// manifest.
+func isFatManifest(contentType string) bool {
+	return contentType == manifestListMediaType || contentType == ociImageIndexMediaType
+}
+
+// parseChildImages extracts the per-platform digests out of a manifest list
+// or OCI image index response body.
+func parseChildImages(body []byte) ([]childImage, error) {
+	var ml manifestList
+	if err := json.Unmarshal(body, &ml); err != nil {
+		return nil, err
+	}
+	children := make([]childImage, 0, len(ml.Manifests))
+	for _, d := range ml.Manifests {
+		children = append(children, childImage{
+			digest:   d.Digest,
+			platform: d.Platform.OS + "/" + d.Platform.Architecture,
+		})
+	}
+	log.Debugf("parsed %d child manifest(s) out of fat manifest", len(children))
+	return children, nil
+}
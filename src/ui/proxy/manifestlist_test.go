@@ -0,0 +1,65 @@
+package proxy
+
+import "testing"
+
+func TestIsFatManifest(t *testing.T) {
+	cases := []struct {
+		contentType string
+		want        bool
+	}{
+		{"application/vnd.docker.distribution.manifest.v1+prettyjws", false},
+		{"application/vnd.docker.distribution.manifest.v2+json", false},
+		{"application/vnd.docker.distribution.manifest.list.v2+json", true},
+		{"application/vnd.oci.image.index.v1+json", true},
+	}
+	for _, c := range cases {
+		if got := isFatManifest(c.contentType); got != c.want {
+			t.Errorf("isFatManifest(%q) = %v, want %v", c.contentType, got, c.want)
+		}
+	}
+}
+
+func TestParseChildImagesManifestList(t *testing.T) {
+	body := []byte(`{
+		"schemaVersion": 2,
+		"mediaType": "application/vnd.docker.distribution.manifest.list.v2+json",
+		"manifests": [
+			{"digest": "sha256:aaa", "platform": {"architecture": "amd64", "os": "linux"}},
+			{"digest": "sha256:bbb", "platform": {"architecture": "arm64", "os": "linux"}}
+		]
+	}`)
+	children, err := parseChildImages(body)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(children) != 2 {
+		t.Fatalf("expected 2 child images, got %d", len(children))
+	}
+	if children[0].digest != "sha256:aaa" || children[0].platform != "linux/amd64" {
+		t.Errorf("unexpected first child: %#v", children[0])
+	}
+	if children[1].digest != "sha256:bbb" || children[1].platform != "linux/arm64" {
+		t.Errorf("unexpected second child: %#v", children[1])
+	}
+}
+
+func TestParseChildImagesEmptyList(t *testing.T) {
+	body := []byte(`{
+		"schemaVersion": 2,
+		"mediaType": "application/vnd.oci.image.index.v1+json",
+		"manifests": []
+	}`)
+	children, err := parseChildImages(body)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(children) != 0 {
+		t.Fatalf("expected 0 child images, got %d", len(children))
+	}
+}
+
+func TestParseChildImagesRejectsGarbage(t *testing.T) {
+	if _, err := parseChildImages([]byte("not json")); err == nil {
+		t.Fatal("expected an error parsing a non-JSON body")
+	}
+}
@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/vmware/harbor/src/common/models"
+)
+
+func TestRegisterMetricsExposesEndpoint(t *testing.T) {
+	mux := http.NewServeMux()
+	RegisterProxyMetrics(mux)
+	// A CounterVec only shows up in a scrape once one of its series exists.
+	pullsTotal.WithLabelValues("allowed", "library")
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	rw := httptest.NewRecorder()
+	mux.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusOK {
+		t.Fatalf("expected /metrics to be registered and return 200, got %d", rw.Code)
+	}
+	if !bytes.Contains(rw.Body.Bytes(), []byte("harbor_proxy_pulls_total")) {
+		t.Fatal("expected the pulls counter to be present in the scrape output")
+	}
+}
+
+func TestFunnelHandlerCountsAllowedPullOnce(t *testing.T) {
+	before := testutil.ToFloat64(pullsTotal.WithLabelValues("allowed", "library"))
+
+	rec = httptest.NewRecorder()
+	rec.WriteHeader(http.StatusOK)
+	rec.Write([]byte("ok"))
+
+	fu := funnelHandler{next: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		t.Fatal("next should not be called once imageInfo is set")
+	})}
+
+	req := httptest.NewRequest(http.MethodGet, "/v2/library/photon/manifests/latest", nil)
+	req = req.WithContext(context.WithValue(req.Context(), imageInfoCtxKey, imageInfo{projectName: "library"}))
+
+	fu.ServeHTTP(httptest.NewRecorder(), req)
+
+	after := testutil.ToFloat64(pullsTotal.WithLabelValues("allowed", "library"))
+	if after != before+1 {
+		t.Fatalf("expected the allowed counter to increase by exactly 1, went from %v to %v", before, after)
+	}
+}
+
+func TestAuditDenialEmitsJSONAndIncrementsDeniedCounter(t *testing.T) {
+	before := testutil.ToFloat64(pullsTotal.WithLabelValues("denied", "library"))
+
+	req := httptest.NewRequest(http.MethodGet, "/v2/library/photon/manifests/latest", nil)
+	img := imageInfo{repository: "library/photon", tag: "latest", projectName: "library", digest: "sha256:abc"}
+	auditDenial(req, img, "not signed in Notary", models.SevUnknown)
+
+	after := testutil.ToFloat64(pullsTotal.WithLabelValues("denied", "library"))
+	if after != before+1 {
+		t.Fatalf("expected the denied counter to increase by exactly 1, went from %v to %v", before, after)
+	}
+}
+
+func TestAuditEventMarshalsExpectedFields(t *testing.T) {
+	ev := auditEvent{
+		Project:    "library",
+		Repository: "library/photon",
+		Tag:        "latest",
+		Digest:     "sha256:abc",
+		User:       "someuser",
+		Reason:     "not signed in Notary",
+	}
+	b, err := json.Marshal(ev)
+	if err != nil {
+		t.Fatalf("unexpected error marshaling audit event: %v", err)
+	}
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatalf("unexpected error unmarshaling audit event: %v", err)
+	}
+	if decoded["reason"] != "not signed in Notary" {
+		t.Fatalf("expected reason to round-trip, got %#v", decoded["reason"])
+	}
+	if _, ok := decoded["severity"]; ok {
+		t.Fatal("expected severity to be omitted when unknown")
+	}
+}
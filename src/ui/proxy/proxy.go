@@ -0,0 +1,28 @@
+package proxy
+
+import "net/http"
+
+// NewRegistryProxy assembles the full registry proxy middleware chain in
+// front of backend, the real docker registry/distribution handler:
+//
+//	pull-through cache -> url handler -> content trust -> vulnerability ->
+//	funnel -> 401 retry -> backend
+//
+// The pull-through cache sits outermost so that a mirror project's manifest
+// pulls are primed from the remote into local storage before urlHandler
+// captures a response to inspect; the 401 retry sits innermost so that both
+// urlHandler's capture call and funnelHandler's real call benefit from it.
+func NewRegistryProxy(backend http.Handler) http.Handler {
+	rh := retryHandler{next: backend}
+	fu := funnelHandler{next: rh}
+	vh := vulnerableHandler{next: fu}
+	cth := contentTrustHandler{next: vh}
+	uh := urlHandler{next: cth}
+	return newPullthroughHandler(uh)
+}
+
+// RegisterProxyMetrics exposes the proxy's Prometheus metrics on mux,
+// alongside wherever the caller mounts NewRegistryProxy.
+func RegisterProxyMetrics(mux *http.ServeMux) {
+	RegisterMetrics(mux)
+}
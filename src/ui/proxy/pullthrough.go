@@ -0,0 +1,303 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vmware/harbor/src/common/models"
+	"github.com/vmware/harbor/src/common/utils/log"
+	"github.com/vmware/harbor/src/ui/config"
+)
+
+// pullThroughCacheTTL bounds how long a resolved tag->digest mapping for a
+// mirrored project is trusted before pullthroughHandler re-resolves it
+// against the remote, so that a repeatedly pulled tag doesn't thrash the
+// upstream.
+const pullThroughCacheTTL = 5 * time.Minute
+
+// localRegistryEndpoint is Harbor's own registry, where pullthroughHandler
+// stores a manifest it fetched from a remote so the rest of the chain (and
+// subsequent pulls) can serve it out of local storage.
+var localRegistryEndpoint = config.LocalRegistryURL()
+
+// localRegistryCredential authenticates storeManifestLocally's push against
+// Harbor's own registry, which gates manifest PUTs behind the same
+// bearer-token challenge as any other v2 endpoint.
+var localRegistryCredential = models.PullThroughRemote{
+	Username: tokenUsername,
+	Password: config.InternalRegistryToken(),
+}
+
+// remoteAuthError marks a pull-through failure as "the remote rejected our
+// credentials" rather than a network/protocol error, so ServeHTTP can send
+// the client a 401 pointing back at Harbor's own token service instead of a
+// generic 502 — the client's own `docker login` is against Harbor, never
+// against the mirrored remote, so that's the challenge it needs to see.
+type remoteAuthError struct {
+	err error
+}
+
+func (e *remoteAuthError) Error() string { return e.err.Error() }
+
+type pullThroughCacheEntry struct {
+	digest   string
+	resolved time.Time
+}
+
+// pullthroughHandler lets a project configured with a PullThroughRemote act
+// as a pull-through cache for an upstream registry: manifest GETs for that
+// project are served out of local storage when already cached, and
+// otherwise fetched from the remote, stored into Harbor's own registry, and
+// then handed off to next so that urlHandler serves the now-local copy and
+// contentTrustHandler/vulnerableHandler still run against it, same as any
+// other pull.
+type pullthroughHandler struct {
+	next http.Handler
+
+	mu    sync.Mutex
+	cache map[string]pullThroughCacheEntry
+}
+
+// newPullthroughHandler builds a pullthroughHandler wrapping next.
+func newPullthroughHandler(next http.Handler) *pullthroughHandler {
+	return &pullthroughHandler{
+		next:  next,
+		cache: make(map[string]pullThroughCacheEntry),
+	}
+}
+
+func (ph *pullthroughHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	flag, repository, tag := MatchPullManifest(req)
+	if !flag {
+		ph.next.ServeHTTP(rw, req)
+		return
+	}
+	projectName := strings.SplitN(repository, "/", 2)[0]
+	enabled, remote := getPolicyChecker().pullThroughRemote(projectName)
+	if !enabled {
+		ph.next.ServeHTTP(rw, req)
+		return
+	}
+	cacheKey := repository + ":" + tag
+	if entry, ok := ph.cachedDigest(cacheKey); ok {
+		log.Debugf("pull-through: serving %s from local cache (digest %s)", cacheKey, entry.digest)
+		ph.next.ServeHTTP(rw, req)
+		return
+	}
+	log.Debugf("pull-through: %s not cached locally, fetching from remote %s", cacheKey, remote.Endpoint)
+	digest, err := ph.fetchAndStore(remote, repository, tag)
+	if err != nil {
+		log.Errorf("pull-through: failed to fetch %s from remote %s: %v", cacheKey, remote.Endpoint, err)
+		if _, ok := err.(*remoteAuthError); ok {
+			rw.Header().Set("WWW-Authenticate", harborBearerChallenge(repository))
+			http.Error(rw, marshalError("Failed to authenticate with the configured pull-through remote, please re-authenticate with Harbor and try again", http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		http.Error(rw, marshalError("Failed to pull through from the configured remote, please check the log", http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	ph.mu.Lock()
+	ph.cache[cacheKey] = pullThroughCacheEntry{digest: digest, resolved: time.Now()}
+	ph.mu.Unlock()
+	// The manifest now lives in local storage; let the rest of the chain
+	// (urlHandler, contentTrustHandler, vulnerableHandler, funnelHandler)
+	// serve and check it exactly like any other pull, which is also how it
+	// gets streamed back to the client.
+	ph.next.ServeHTTP(rw, req)
+}
+
+func (ph *pullthroughHandler) cachedDigest(cacheKey string) (pullThroughCacheEntry, bool) {
+	ph.mu.Lock()
+	defer ph.mu.Unlock()
+	entry, ok := ph.cache[cacheKey]
+	if !ok || time.Since(entry.resolved) >= pullThroughCacheTTL {
+		return pullThroughCacheEntry{}, false
+	}
+	return entry, true
+}
+
+// fetchAndStore pulls the manifest for repository:tag from the upstream
+// remote, authenticating with a Bearer token exchange if the remote
+// challenges the first request, then pushes the fetched bytes into
+// Harbor's own registry so the rest of the chain can serve them locally.
+// It returns the resolved digest so the caller can cache it.
+func (ph *pullthroughHandler) fetchAndStore(remote models.PullThroughRemote, repository, tag string) (string, error) {
+	manifestURL := fmt.Sprintf("%s/v2/%s/manifests/%s", strings.TrimSuffix(remote.Endpoint, "/"), repository, tag)
+	resp, err := ph.getWithAuth(remote, manifestURL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("remote %s returned %d for %s:%s", remote.Endpoint, resp.StatusCode, repository, tag)
+	}
+	contentType := resp.Header.Get(http.CanonicalHeaderKey("Content-Type"))
+	digest := resp.Header.Get(http.CanonicalHeaderKey("Docker-Content-Digest"))
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if err := storeManifestLocally(repository, tag, contentType, body); err != nil {
+		return "", fmt.Errorf("failed to store pulled-through manifest locally: %v", err)
+	}
+	return digest, nil
+}
+
+// getWithAuth performs a GET of manifestURL, and if the remote challenges it with a 401
+// carrying a Bearer WWW-Authenticate header, exchanges remote's credentials
+// for a token against the realm/service/scope named in that challenge and
+// retries once with it. docker registries (Docker Hub, another Harbor)
+// gate every v2 endpoint behind exactly this dance, so without it every
+// pull-through fetch against a real upstream would fail with 401.
+func (ph *pullthroughHandler) getWithAuth(remote models.PullThroughRemote, manifestURL string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, manifestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		return resp, nil
+	}
+	challenge := resp.Header.Get(http.CanonicalHeaderKey("WWW-Authenticate"))
+	resp.Body.Close()
+	realm, service, scope, ok := parseBearerChallenge(challenge)
+	if !ok {
+		return nil, &remoteAuthError{fmt.Errorf("remote returned 401 with no usable Bearer challenge: %q", challenge)}
+	}
+	token, err := fetchBearerToken(remote, realm, service, scope)
+	if err != nil {
+		return nil, &remoteAuthError{fmt.Errorf("failed to exchange credentials for a bearer token: %v", err)}
+	}
+	req, err = http.NewRequest(http.MethodGet, manifestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return http.DefaultClient.Do(req)
+}
+
+// harborBearerChallenge builds the WWW-Authenticate header Harbor's own
+// docker clients already know how to answer: a Bearer challenge against
+// Harbor's external token service, scoped to a pull on repository.
+func harborBearerChallenge(repository string) string {
+	realm := strings.TrimSuffix(config.ExtEndpoint(), "/") + "/service/token"
+	return fmt.Sprintf(`Bearer realm="%s",service="harbor-registry",scope="repository:%s:pull"`, realm, repository)
+}
+
+// parseBearerChallenge extracts realm/service/scope out of a
+// `Bearer realm="...",service="...",scope="..."` WWW-Authenticate header.
+func parseBearerChallenge(header string) (realm, service, scope string, ok bool) {
+	const prefix = "Bearer "
+	if !strings.HasPrefix(header, prefix) {
+		return "", "", "", false
+	}
+	values := map[string]string{}
+	for _, part := range strings.Split(strings.TrimPrefix(header, prefix), ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		values[kv[0]] = strings.Trim(kv[1], `"`)
+	}
+	realm = values["realm"]
+	return realm, values["service"], values["scope"], realm != ""
+}
+
+// fetchBearerToken requests a token from realm using remote's credentials,
+// scoped to service/scope, mirroring the docker registry token auth flow.
+func fetchBearerToken(remote models.PullThroughRemote, realm, service, scope string) (string, error) {
+	u, err := url.Parse(realm)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	if service != "" {
+		q.Set("service", service)
+	}
+	if scope != "" {
+		q.Set("scope", scope)
+	}
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if remote.Username != "" {
+		req.SetBasicAuth(remote.Username, remote.Password)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint %s returned %d", realm, resp.StatusCode)
+	}
+	var tokenResp struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+		return "", err
+	}
+	if tokenResp.Token != "" {
+		return tokenResp.Token, nil
+	}
+	return tokenResp.AccessToken, nil
+}
+
+// storeManifestLocally pushes a pulled-through manifest into Harbor's own
+// registry so that subsequent pulls, and the rest of the proxy chain for
+// this one, can serve it out of local storage. Harbor's registry requires
+// auth for the PUT just like any other v2 endpoint, so this authenticates
+// with localRegistryCredential the same way fetchAndStore authenticates
+// against the upstream remote.
+func storeManifestLocally(repository, tag, contentType string, body []byte) error {
+	manifestURL := fmt.Sprintf("%s/v2/%s/manifests/%s", strings.TrimSuffix(localRegistryEndpoint, "/"), repository, tag)
+	put := func(token string) (*http.Response, error) {
+		req, err := http.NewRequest(http.MethodPut, manifestURL, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", contentType)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		return http.DefaultClient.Do(req)
+	}
+	resp, err := put("")
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		challenge := resp.Header.Get(http.CanonicalHeaderKey("WWW-Authenticate"))
+		resp.Body.Close()
+		realm, service, scope, ok := parseBearerChallenge(challenge)
+		if !ok {
+			return fmt.Errorf("local registry returned 401 with no usable Bearer challenge: %q", challenge)
+		}
+		token, err := fetchBearerToken(localRegistryCredential, realm, service, scope)
+		if err != nil {
+			return fmt.Errorf("failed to authenticate with the local registry: %v", err)
+		}
+		resp, err = put(token)
+		if err != nil {
+			return err
+		}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("local registry returned %d storing %s:%s", resp.StatusCode, repository, tag)
+	}
+	return nil
+}
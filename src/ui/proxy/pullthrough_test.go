@@ -0,0 +1,187 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/vmware/harbor/src/common/models"
+)
+
+func TestParseBearerChallenge(t *testing.T) {
+	realm, service, scope, ok := parseBearerChallenge(`Bearer realm="https://auth.example.com/token",service="registry.example.com",scope="repository:library/photon:pull"`)
+	if !ok {
+		t.Fatal("expected the challenge to parse")
+	}
+	if realm != "https://auth.example.com/token" || service != "registry.example.com" || scope != "repository:library/photon:pull" {
+		t.Fatalf("unexpected parse result: realm=%q service=%q scope=%q", realm, service, scope)
+	}
+	if _, _, _, ok := parseBearerChallenge("Basic realm=\"foo\""); ok {
+		t.Fatal("expected a non-Bearer challenge to be rejected")
+	}
+}
+
+func TestFetchAndStorePrimesLocalStorage(t *testing.T) {
+	const manifestBody = `{"schemaVersion":2}`
+
+	remoteServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "application/vnd.docker.distribution.manifest.v2+json")
+		rw.Header().Set("Docker-Content-Digest", "sha256:remotedigest")
+		rw.Write([]byte(manifestBody))
+	}))
+	defer remoteServer.Close()
+
+	var storedBody []byte
+	var storedContentType string
+	localServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPut {
+			t.Errorf("expected a PUT to store the manifest, got %s", req.Method)
+		}
+		storedContentType = req.Header.Get("Content-Type")
+		storedBody, _ = ioutil.ReadAll(req.Body)
+		rw.WriteHeader(http.StatusCreated)
+	}))
+	defer localServer.Close()
+
+	previous := localRegistryEndpoint
+	localRegistryEndpoint = localServer.URL
+	defer func() { localRegistryEndpoint = previous }()
+
+	ph := newPullthroughHandler(nil)
+	remote := models.PullThroughRemote{Endpoint: remoteServer.URL}
+	digest, err := ph.fetchAndStore(remote, "library/photon", "latest")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if digest != "sha256:remotedigest" {
+		t.Fatalf("unexpected digest: %s", digest)
+	}
+	if string(storedBody) != manifestBody {
+		t.Fatalf("expected the fetched manifest to be stored locally, got %q", storedBody)
+	}
+	if storedContentType != "application/vnd.docker.distribution.manifest.v2+json" {
+		t.Fatalf("unexpected stored content type: %s", storedContentType)
+	}
+}
+
+func TestFetchAndStoreRetriesWithBearerToken(t *testing.T) {
+	const manifestBody = `{"schemaVersion":2}`
+	var tokenServerHit bool
+
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		tokenServerHit = true
+		user, pass, ok := req.BasicAuth()
+		if !ok || user != "mirror-user" || pass != "mirror-pass" {
+			t.Errorf("expected the configured mirror credentials, got %q/%q (ok=%v)", user, pass, ok)
+		}
+		rw.Write([]byte(`{"token":"fake-token"}`))
+	}))
+	defer tokenServer.Close()
+
+	var remoteServer *httptest.Server
+	remoteServer = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer fake-token" {
+			rw.Header().Set("WWW-Authenticate", `Bearer realm="`+tokenServer.URL+`",service="registry",scope="repository:library/photon:pull"`)
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/vnd.docker.distribution.manifest.v2+json")
+		rw.Header().Set("Docker-Content-Digest", "sha256:remotedigest")
+		rw.Write([]byte(manifestBody))
+	}))
+	defer remoteServer.Close()
+
+	localServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusCreated)
+	}))
+	defer localServer.Close()
+
+	previous := localRegistryEndpoint
+	localRegistryEndpoint = localServer.URL
+	defer func() { localRegistryEndpoint = previous }()
+
+	ph := newPullthroughHandler(nil)
+	remote := models.PullThroughRemote{Endpoint: remoteServer.URL, Username: "mirror-user", Password: "mirror-pass"}
+	if _, err := ph.fetchAndStore(remote, "library/photon", "latest"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !tokenServerHit {
+		t.Fatal("expected the bearer token endpoint to be called after the initial 401")
+	}
+}
+
+func TestStoreManifestLocallyAuthenticatesWithBearerToken(t *testing.T) {
+	const manifestBody = `{"schemaVersion":2}`
+	var tokenServerHit bool
+
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		tokenServerHit = true
+		user, pass, ok := req.BasicAuth()
+		if !ok || user != tokenUsername {
+			t.Errorf("expected the local registry credential's username, got %q (ok=%v)", user, ok)
+		}
+		_ = pass
+		rw.Write([]byte(`{"token":"local-fake-token"}`))
+	}))
+	defer tokenServer.Close()
+
+	var storedBody []byte
+	localServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer local-fake-token" {
+			rw.Header().Set("WWW-Authenticate", `Bearer realm="`+tokenServer.URL+`",service="harbor-registry",scope="repository:library/photon:pull,push"`)
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		storedBody, _ = ioutil.ReadAll(req.Body)
+		rw.WriteHeader(http.StatusCreated)
+	}))
+	defer localServer.Close()
+
+	previousEndpoint := localRegistryEndpoint
+	localRegistryEndpoint = localServer.URL
+	defer func() { localRegistryEndpoint = previousEndpoint }()
+
+	if err := storeManifestLocally("library/photon", "latest", "application/vnd.docker.distribution.manifest.v2+json", []byte(manifestBody)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !tokenServerHit {
+		t.Fatal("expected the local registry's bearer token endpoint to be called after the initial 401")
+	}
+	if string(storedBody) != manifestBody {
+		t.Fatalf("expected the manifest to be stored after authenticating, got %q", storedBody)
+	}
+}
+
+func TestHarborBearerChallengeScopesToRepository(t *testing.T) {
+	challenge := harborBearerChallenge("library/photon")
+	if !strings.HasPrefix(challenge, "Bearer ") {
+		t.Fatalf("expected a Bearer challenge, got %q", challenge)
+	}
+	realm, service, scope, ok := parseBearerChallenge(challenge)
+	if !ok {
+		t.Fatalf("expected the built challenge to parse, got %q", challenge)
+	}
+	if realm == "" || service != "harbor-registry" || scope != "repository:library/photon:pull" {
+		t.Fatalf("unexpected challenge fields: realm=%q service=%q scope=%q", realm, service, scope)
+	}
+}
+
+func TestFetchAndStoreReturnsRemoteAuthErrorWhenTokenExchangeFails(t *testing.T) {
+	remoteServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("WWW-Authenticate", `Bearer realm="https://auth.example.invalid/token",service="registry",scope="repository:library/photon:pull"`)
+		rw.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer remoteServer.Close()
+
+	ph := newPullthroughHandler(nil)
+	remote := models.PullThroughRemote{Endpoint: remoteServer.URL}
+	_, err := ph.fetchAndStore(remote, "library/photon", "latest")
+	if err == nil {
+		t.Fatal("expected fetchAndStore to fail when the remote rejects auth")
+	}
+	if _, ok := err.(*remoteAuthError); !ok {
+		t.Fatalf("expected a *remoteAuthError so ServeHTTP re-challenges against Harbor, got %T: %v", err, err)
+	}
+}
@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/vmware/harbor/src/common/utils/log"
+)
+
+const (
+	// retryBackoff is how long to wait between the 2nd and subsequent retries.
+	retryBackoff = 500 * time.Millisecond
+	// retryWindow is the total time, measured from the first attempt, during
+	// which retries are allowed.  Token issuance carries nbf/iat set to "now",
+	// so a request that lands on a node with a slightly skewed clock can see a
+	// spurious 401 right after the token was minted; retrying briefly rides
+	// out the skew without masking a real auth failure.
+	retryWindow = 3 * time.Second
+)
+
+// retryHandler retries a request against the next handler when it responds
+// with 401 Unauthorized, to absorb clock-skew related token rejections. It
+// captures the response with the same httptest.ResponseRecorder mechanism
+// urlHandler uses so downstream interceptors still see the final response.
+type retryHandler struct {
+	next http.Handler
+}
+
+func (rh retryHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	start := time.Now()
+	rec := httptest.NewRecorder()
+	rh.next.ServeHTTP(rec, req)
+	for attempt := 1; rec.Result().StatusCode == http.StatusUnauthorized; attempt++ {
+		if time.Since(start) >= retryWindow {
+			log.Debugf("401 retry window (%s) exhausted for %s, giving up after %d attempt(s)", retryWindow, req.URL.Path, attempt)
+			break
+		}
+		if attempt > 1 {
+			time.Sleep(retryBackoff)
+		}
+		log.Debugf("got 401 for %s, retrying (attempt %d)", req.URL.Path, attempt+1)
+		rec = httptest.NewRecorder()
+		rh.next.ServeHTTP(rec, req)
+	}
+	copyResp(rec, rw)
+}
@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// flakyUpstream returns 401 Unauthorized for the first failCount requests,
+// then 200 OK, so tests can exercise retryHandler's retry-on-401 behavior.
+type flakyUpstream struct {
+	failCount int
+	seen      int
+}
+
+func (f *flakyUpstream) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	f.seen++
+	if f.seen <= f.failCount {
+		rw.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+}
+
+func TestRetryHandlerRetriesOn401(t *testing.T) {
+	upstream := &flakyUpstream{failCount: 2}
+	rh := retryHandler{next: upstream}
+	req := httptest.NewRequest(http.MethodGet, "/v2/library/photon/manifests/latest", nil)
+	rw := httptest.NewRecorder()
+
+	rh.ServeHTTP(rw, req)
+
+	if rw.Result().StatusCode != http.StatusOK {
+		t.Fatalf("expected the retry to eventually succeed, got status %d", rw.Result().StatusCode)
+	}
+	if upstream.seen != 3 {
+		t.Fatalf("expected 3 attempts (1 initial + 2 retries), got %d", upstream.seen)
+	}
+}
+
+func TestRetryHandlerGivesUpAfterWindow(t *testing.T) {
+	upstream := &flakyUpstream{failCount: 1000}
+	rh := retryHandler{next: upstream}
+	req := httptest.NewRequest(http.MethodGet, "/v2/library/photon/manifests/latest", nil)
+	rw := httptest.NewRecorder()
+
+	rh.ServeHTTP(rw, req)
+
+	if rw.Result().StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected a persistent 401 to surface after the retry window, got status %d", rw.Result().StatusCode)
+	}
+	if upstream.seen < 2 {
+		t.Fatalf("expected at least one retry before giving up, got %d attempt(s)", upstream.seen)
+	}
+}
@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"time"
+
+	"github.com/vmware/harbor/src/common/models"
+	"github.com/vmware/harbor/src/common/utils/log"
+	"github.com/vmware/harbor/src/common/utils/notary"
+)
+
+// trustPolicyError distinguishes *why* a pull was refused under a project's
+// trust policy, so the caller can surface an actionable message instead of
+// a generic "not signed" response.
+type trustPolicyError struct {
+	msg string
+}
+
+func (e trustPolicyError) Error() string {
+	return e.msg
+}
+
+var (
+	errKeyRotationDetected = trustPolicyError{"key rotation detected"}
+	errMetadataExpired     = trustPolicyError{"metadata expired"}
+)
+
+// baseTargetsRole is the non-delegated "targets" role every repository has;
+// entries in policy.AllowedSigners name delegation roles layered on top of
+// it (e.g. "targets/releases").
+const baseTargetsRole = "targets"
+
+// matchNotaryDigest resolves img's tag against Notary, walking the
+// delegation roles policy requires (or the base targets role when no
+// allowlist is configured), in that order, stopping at the first role
+// that has a target for img.tag. It enforces policy on whichever role
+// matched: the repository's targets metadata must not have been expired for
+// longer than policy.MetadataGracePeriod, and the root/targets key IDs backing it
+// must match policy's pinned keys (when set) so that a silent Notary key
+// rotation is refused rather than trusted on first use.
+func matchNotaryDigest(img imageInfo, policy models.TrustPolicy) (bool, error) {
+	matchedDigest, matchedRole, found, err := resolveDelegatedTarget(img.repository, img.tag, policy.AllowedSigners)
+	if err != nil {
+		return false, err
+	}
+	if !found {
+		log.Debugf("image: %#v, not found in notary", img)
+		return false, nil
+	}
+	log.Debugf("found tag %s signed by role %s in notary, try to match digest.", img.tag, matchedRole)
+
+	if policy.MetadataGracePeriod > 0 {
+		expires, err := notary.GetTargetsExpiration(NotaryEndpoint, tokenUsername, img.repository)
+		if err != nil {
+			return false, err
+		}
+		if time.Since(expires) > policy.MetadataGracePeriod {
+			return false, errMetadataExpired
+		}
+	}
+	if len(policy.PinnedRootKeyIDs) > 0 || len(policy.PinnedTargetKeyIDs) > 0 {
+		rootKeyIDs, targetKeyIDs, err := notary.GetInternalKeyIDs(NotaryEndpoint, tokenUsername, img.repository)
+		if err != nil {
+			return false, err
+		}
+		if !pinnedKeysMatch(policy.PinnedRootKeyIDs, rootKeyIDs) || !pinnedKeysMatch(policy.PinnedTargetKeyIDs, targetKeyIDs) {
+			return false, errKeyRotationDetected
+		}
+	}
+	return img.digest == matchedDigest, nil
+}
+
+// resolveDelegatedTarget queries Notary once per role (this is the
+// delegation traversal: docker's own trust model never loads every
+// delegation in one call, callers have to ask for the roles they care
+// about) and returns the digest and role name of the first target it
+// finds for tag. When allowedSigners is set, only those delegation roles
+// are consulted — the base targets role must not count on its own, or a
+// tag that exists there but was never co-signed by a required delegation
+// would still pass. With no allowlist configured, the base targets role
+// is the only one consulted.
+func resolveDelegatedTarget(repository, tag string, allowedSigners []string) (digest string, role string, found bool, err error) {
+	roles := []string{baseTargetsRole}
+	if len(allowedSigners) > 0 {
+		roles = allowedSigners
+	}
+	for _, r := range roles {
+		targets, err := notary.GetInternalTargets(NotaryEndpoint, tokenUsername, repository, r)
+		if err != nil {
+			return "", "", false, err
+		}
+		for _, t := range targets {
+			if t.Tag != tag {
+				continue
+			}
+			d, err := notary.DigestFromTarget(t)
+			if err != nil {
+				return "", "", false, err
+			}
+			return d, r, true, nil
+		}
+	}
+	return "", "", false, nil
+}
+
+// pinnedKeysMatch reports whether actual is exactly the set of key IDs
+// pinned by policy. An empty pin list means "no pin configured", which
+// always matches. The comparison must be exact rather than subset: if
+// Notary were trusted whenever the pinned keys were merely still present,
+// an additive rotation — the old pinned key left in place alongside a
+// newly added one — would go undetected, silently widening the set of
+// keys that can sign for the repository.
+func pinnedKeysMatch(pinned, actual []string) bool {
+	if len(pinned) == 0 {
+		return true
+	}
+	if len(pinned) != len(actual) {
+		return false
+	}
+	for _, k := range pinned {
+		if !stringInSlice(k, actual) {
+			return false
+		}
+	}
+	return true
+}
+
+func stringInSlice(s string, list []string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,34 @@
+package proxy
+
+import "testing"
+
+func TestPinnedKeysMatch(t *testing.T) {
+	cases := []struct {
+		name   string
+		pinned []string
+		actual []string
+		want   bool
+	}{
+		{"no pin configured", nil, []string{"key1"}, true},
+		{"exact pinned keys present", []string{"key1", "key2"}, []string{"key1", "key2"}, true},
+		{"pinned key rotated away", []string{"key1"}, []string{"key2"}, false},
+		{"all pinned keys required", []string{"key1", "key2"}, []string{"key1"}, false},
+		{"additive key rotation detected", []string{"key1"}, []string{"key1", "key2"}, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := pinnedKeysMatch(c.pinned, c.actual); got != c.want {
+				t.Fatalf("pinnedKeysMatch(%v, %v) = %v, want %v", c.pinned, c.actual, got, c.want)
+			}
+		})
+	}
+}
+
+func TestStringInSlice(t *testing.T) {
+	if !stringInSlice("targets/releases", []string{"targets", "targets/releases"}) {
+		t.Fatal("expected to find targets/releases in the slice")
+	}
+	if stringInSlice("targets/releases", []string{"targets"}) {
+		t.Fatal("did not expect to find targets/releases in the slice")
+	}
+}